@@ -13,6 +13,7 @@ import (
 	"net"
 	"net/http"
 	"regexp"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -30,14 +31,57 @@ type Config struct {
 	StatsdClient                 *statsd.Client
 	EgressAcl                    EgressAcl
 	SupportProxyProtocol         bool
+	tlsMu                        sync.RWMutex
 	TlsConfig                    *tls.Config
 	CrlByAuthorityKeyId          map[string]*pkix.CertificateList
 	RoleFromRequest              func(subject *http.Request) (string, error)
+	clientCaMu                   sync.RWMutex
 	clientCasBySubjectKeyId      map[string]*x509.Certificate
 	AdditionalErrorMessageOnDeny string
 	Log                          *log.Logger
 	DisabledAclPolicyActions     []string
 
+	// CrlRefreshInterval controls how often the background CRL manager
+	// polls each CA's CRL Distribution Points for an updated list. Defaults
+	// to DefaultCrlRefreshInterval.
+	CrlRefreshInterval time.Duration
+	// CrlHardExpiry is how long past a CRL's NextUpdate smokescreen will
+	// keep trusting it (and the CA it belongs to) once refreshes start
+	// failing. Defaults to DefaultCrlHardExpiry.
+	CrlHardExpiry time.Duration
+	crlMu         sync.RWMutex
+	crlManager    *crlManager
+	// hardExpiredAuthorityKeyIds tracks CAs whose CRL has gone past
+	// CrlHardExpiry. Certificates issued by these CAs are rejected by the
+	// revocation check even though the CA's root may still be present in
+	// TlsConfig.ClientCAs. Guarded by crlMu.
+	hardExpiredAuthorityKeyIds map[string]bool
+
+	// RevocationMode selects whether client certificate revocation is
+	// checked via CRL, OCSP, both, or not at all. Defaults to RevocationOff:
+	// no enforcement happens at the mTLS handshake until SetupOcsp is called
+	// to opt in, for backwards compatibility with configs that only ever
+	// called SetupCrls.
+	RevocationMode RevocationMode
+	// OcspResponderOverrides maps a hex-encoded Authority Key Identifier to
+	// an OCSP responder URL to use instead of the cert's own OCSPServer
+	// field.
+	OcspResponderOverrides map[string]string
+	// OcspSoftFail, when true, treats OCSP lookup failures as "good" rather
+	// than rejecting the connection.
+	OcspSoftFail bool
+	ocspCache    *ocspCache
+	ocspStapleMu sync.Mutex
+	// ocspStapleStopCh, when non-nil, signals the OCSP stapling refresh
+	// goroutine started by StartOcspStapling to exit. Guarded by
+	// ocspStapleMu.
+	ocspStapleStopCh    chan struct{}
+	ocspStapleStoppedCh chan struct{}
+
+	// reloadable tracks the file paths Setup* was called with, so Reload
+	// can re-read them from scratch.
+	reloadable *reloadableConfig
+
 	hostExtractExpr *regexp.Regexp
 }
 
@@ -126,11 +170,42 @@ func (config *Config) Init() error {
 	return nil
 }
 
+// parseCrlBytes parses a DER-encoded CRL.
+func parseCrlBytes(crlBytes []byte) (*pkix.CertificateList, error) {
+	return x509.ParseCRL(crlBytes)
+}
+
+// crlAuthorityKeyId extracts the CRL issuer's Authority Key Identifier
+// (RFC 5280, 4.2.1.1). It returns an empty string if the extension is absent
+// or cannot be decoded.
+func crlAuthorityKeyId(certList *pkix.CertificateList) string {
+	// find the X509v3 Authority Key Identifier in the extensions (2.5.29.35)
+	extensionOid := []int{2, 5, 29, 35}
+	for _, v := range certList.TBSCertList.Extensions {
+		if v.Id.Equal(extensionOid) { // Hurray, we found it
+			// Boo, it's ASN.1.
+			var crlAuthorityKey authKeyId
+			_, err := asn1.Unmarshal(v.Value, &crlAuthorityKey)
+			if err != nil {
+				fmt.Printf("error: Failed to read AuthorityKey: %#v\n", err)
+				return ""
+			}
+			return string(crlAuthorityKey.Id)
+		}
+	}
+	return ""
+}
+
 func (config *Config) SetupCrls(crlFiles []string) error {
 	fail := func(err error) error { fmt.Print(err); return err }
 
-	config.CrlByAuthorityKeyId = make(map[string]*pkix.CertificateList)
-	config.clientCasBySubjectKeyId = make(map[string]*x509.Certificate)
+	config.ensureReloadable()
+	config.reloadable.mu.Lock()
+	config.reloadable.crlFiles = crlFiles
+	config.reloadable.mu.Unlock()
+
+	newCrls := make(map[string]*pkix.CertificateList)
+	config.resetClientCas()
 
 	for _, crlFile := range crlFiles {
 		crlBytes, err := ioutil.ReadFile(crlFile)
@@ -138,38 +213,23 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 			return fail(err)
 		}
 
-		certList, err := x509.ParseCRL(crlBytes)
+		certList, err := parseCrlBytes(crlBytes)
 		if err != nil {
 			log.Printf("Failed to parse CRL in '%s': %#v\n", crlFile, err)
 		}
 
-		// find the X509v3 Authority Key Identifier in the extensions (2.5.29.35)
-		crlIssuerId := ""
-		extensionOid := []int{2, 5, 29, 35}
-		for _, v := range certList.TBSCertList.Extensions {
-			if v.Id.Equal(extensionOid) { // Hurray, we found it
-				// Boo, it's ASN.1.
-				var crlAuthorityKey authKeyId
-				_, err := asn1.Unmarshal(v.Value, &crlAuthorityKey)
-				if err != nil {
-					fmt.Printf("error: Failed to read AuthorityKey: %#v\n", err)
-					continue
-				}
-				crlIssuerId = string(crlAuthorityKey.Id)
-				break
-			}
-		}
+		crlIssuerId := crlAuthorityKeyId(certList)
 		if crlIssuerId == "" {
 			log.Print(fmt.Errorf("error: CRL from '%s' has no Authority Key Identifier: ignoring it\n", crlFile))
 			continue
 		}
 
 		// Make sure we have a CA for this CRL or warn
-		caCert, ok := config.clientCasBySubjectKeyId[crlIssuerId]
+		caCert, ok := config.getClientCa(crlIssuerId)
 
 		if !ok {
 			log.Printf("warn: CRL loaded for issuer '%s' but no such CA loaded: ignoring it\n", hex.EncodeToString([]byte(crlIssuerId)))
-			fmt.Printf("%#v loaded certs\n", len(config.clientCasBySubjectKeyId))
+			fmt.Printf("%#v loaded certs\n", len(config.clientCaIds()))
 			continue
 		}
 
@@ -181,17 +241,32 @@ func (config *Config) SetupCrls(crlFiles []string) error {
 		}
 
 		// At this point, we have a new CRL which we trust. Let's evict the old one.
-		config.CrlByAuthorityKeyId[crlIssuerId] = certList
+		newCrls[crlIssuerId] = certList
 		fmt.Printf("info: Loaded CRL for Authority ID '%s'\n", hex.EncodeToString([]byte(crlIssuerId)))
 	}
 
+	// Swap in the new CRL set only once every file has been read, so an
+	// error above leaves the previously-trusted CRLs in place.
+	config.crlMu.Lock()
+	config.CrlByAuthorityKeyId = newCrls
+	config.crlMu.Unlock()
+
 	// Verify that all CAs loaded have a CRL
-	for k, _ := range config.clientCasBySubjectKeyId {
+	config.crlMu.RLock()
+	for _, k := range config.clientCaIds() {
 		_, ok := config.CrlByAuthorityKeyId[k]
 		if !ok {
 			fmt.Printf("warn: no CRL loaded for Authority ID '%s'\n", hex.EncodeToString([]byte(k)))
 		}
 	}
+	config.crlMu.RUnlock()
+
+	// New CAs may have arrived with CRL Distribution Points of their own;
+	// kick off an immediate fetch rather than waiting for the next tick.
+	if config.crlManager != nil {
+		go config.crlManager.refreshAll()
+	}
+
 	return nil
 }
 
@@ -218,6 +293,11 @@ func (config *Config) SetupStatsd(addr string) error {
 }
 
 func (config *Config) SetupEgressAcl(aclFile string) error {
+	config.ensureReloadable()
+	config.reloadable.mu.Lock()
+	config.reloadable.aclFile = aclFile
+	config.reloadable.mu.Unlock()
+
 	if aclFile == "" {
 		config.EgressAcl = nil
 		return nil
@@ -274,15 +354,62 @@ func (config *Config) SetupTls(certFile, keyFile string, clientCAFiles []string)
 		}
 	}
 
-		config.TlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{serverCert},
-			ClientAuth: clientAuth,
-			ClientCAs: clientCAs,
-		}
+	config.setTlsConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   clientAuth,
+		ClientCAs:    clientCAs,
+	})
+	config.wireGetConfigForClient()
+
+	config.ensureReloadable()
+	config.reloadable.mu.Lock()
+	config.reloadable.certKeyPairs = [][2]string{{certFile, keyFile}}
+	config.reloadable.clientCAFiles = clientCAFiles
+	config.reloadable.mu.Unlock()
 
 	return nil
 }
 
+// setClientCa records cert under its Subject Key Identifier. It is safe for
+// concurrent use with the background CRL refresh goroutine and a concurrent
+// Reload.
+func (config *Config) setClientCa(cert *x509.Certificate) {
+	config.clientCaMu.Lock()
+	defer config.clientCaMu.Unlock()
+	config.clientCasBySubjectKeyId[string(cert.SubjectKeyId)] = cert
+}
+
+func (config *Config) getClientCa(authorityKeyId string) (*x509.Certificate, bool) {
+	config.clientCaMu.RLock()
+	defer config.clientCaMu.RUnlock()
+	cert, ok := config.clientCasBySubjectKeyId[authorityKeyId]
+	return cert, ok
+}
+
+func (config *Config) deleteClientCa(authorityKeyId string) {
+	config.clientCaMu.Lock()
+	defer config.clientCaMu.Unlock()
+	delete(config.clientCasBySubjectKeyId, authorityKeyId)
+}
+
+func (config *Config) resetClientCas() {
+	config.clientCaMu.Lock()
+	defer config.clientCaMu.Unlock()
+	config.clientCasBySubjectKeyId = make(map[string]*x509.Certificate)
+}
+
+// clientCaIds returns a snapshot of the currently loaded client CAs' Subject
+// Key Identifiers.
+func (config *Config) clientCaIds() []string {
+	config.clientCaMu.RLock()
+	defer config.clientCaMu.RUnlock()
+	ids := make([]string, 0, len(config.clientCasBySubjectKeyId))
+	for id := range config.clientCasBySubjectKeyId {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
 func (config *Config) populateClientCaMap(pemCerts []byte) (ok bool) {
 
 	for len(pemCerts) > 0 {
@@ -300,8 +427,30 @@ func (config *Config) populateClientCaMap(pemCerts []byte) (ok bool) {
 			continue
 		}
 		fmt.Printf("info: Loaded CA with Authority ID '%s'\n", hex.EncodeToString(cert.SubjectKeyId))
-		config.clientCasBySubjectKeyId[string(cert.SubjectKeyId)] = cert
+		config.setClientCa(cert)
 		ok = true
+
+		config.registerCrlUrls(cert)
 	}
 	return
 }
+
+// registerCrlUrls records the CRL Distribution Point URLs advertised by cert
+// so the background CRL manager can keep its CRL fresh without an operator
+// having to list the URL out-of-band. Only the CRLDistributionPoints
+// extension is read; no other URL on the certificate is used as a CRL
+// source.
+func (config *Config) registerCrlUrls(cert *x509.Certificate) {
+	urls := append([]string{}, cert.CRLDistributionPoints...)
+	if len(urls) == 0 {
+		return
+	}
+
+	config.ensureCrlManager()
+	config.crlManager.mu.Lock()
+	authorityKeyId := string(cert.SubjectKeyId)
+	for _, url := range urls {
+		config.crlManager.urlsByIssuer[authorityKeyId] = appendUnique(config.crlManager.urlsByIssuer[authorityKeyId], url)
+	}
+	config.crlManager.mu.Unlock()
+}
@@ -0,0 +1,301 @@
+package smokescreen
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultCrlRefreshInterval is how often we check configured CRL Distribution
+// Points for a newer CRL when the operator hasn't overridden it.
+const DefaultCrlRefreshInterval = time.Hour
+
+// DefaultCrlHardExpiry is how long past a CRL's NextUpdate we'll keep serving
+// it (logging staleness) before treating the issuing CA as untrusted.
+const DefaultCrlHardExpiry = 24 * time.Hour
+
+// crlManager periodically re-fetches CRLs from the Distribution Points
+// discovered on loaded client CAs and keeps Config.CrlByAuthorityKeyId fresh.
+type crlManager struct {
+	config *Config
+
+	mu            sync.Mutex
+	urlsByIssuer  map[string][]string
+	fetchedAt     map[string]time.Time
+	refreshTicker *time.Ticker
+	stopCh        chan struct{}
+	stoppedCh     chan struct{}
+}
+
+func newCrlManager(config *Config) *crlManager {
+	return &crlManager{
+		config:       config,
+		urlsByIssuer: make(map[string][]string),
+		fetchedAt:    make(map[string]time.Time),
+	}
+}
+
+// SetCrlRefreshInterval overrides how often CRL Distribution Points are
+// polled for an updated CRL. It must be called before StartCrlRefresh.
+func (config *Config) SetCrlRefreshInterval(interval time.Duration) {
+	config.CrlRefreshInterval = interval
+}
+
+// AddCrlURL registers an additional CRL Distribution Point URL for the CA
+// identified by authorityKeyId, in addition to any discovered from the
+// certificate itself. It triggers an immediate fetch.
+func (config *Config) AddCrlURL(authorityKeyId, url string) {
+	config.ensureCrlManager()
+	config.crlManager.mu.Lock()
+	config.crlManager.urlsByIssuer[authorityKeyId] = appendUnique(config.crlManager.urlsByIssuer[authorityKeyId], url)
+	config.crlManager.mu.Unlock()
+
+	go config.crlManager.refreshIssuer(authorityKeyId)
+}
+
+func appendUnique(urls []string, url string) []string {
+	for _, u := range urls {
+		if u == url {
+			return urls
+		}
+	}
+	return append(urls, url)
+}
+
+func (config *Config) ensureCrlManager() {
+	if config.CrlRefreshInterval == 0 {
+		config.CrlRefreshInterval = DefaultCrlRefreshInterval
+	}
+	if config.CrlHardExpiry == 0 {
+		config.CrlHardExpiry = DefaultCrlHardExpiry
+	}
+	if config.crlManager == nil {
+		config.crlManager = newCrlManager(config)
+	}
+}
+
+// StartCrlRefresh launches the background goroutine that periodically
+// refreshes CRLs from their Distribution Points. Callers should arrange for
+// Stop to be invoked during shutdown, alongside ExitTimeout.
+func (config *Config) StartCrlRefresh() {
+	config.ensureCrlManager()
+	m := config.crlManager
+	if m.stopCh != nil {
+		// already running
+		return
+	}
+	m.stopCh = make(chan struct{})
+	m.stoppedCh = make(chan struct{})
+
+	go m.run()
+}
+
+// Stop signals the CRL refresh goroutine to exit and waits for it to finish.
+func (config *Config) Stop() {
+	if config.crlManager == nil || config.crlManager.stopCh == nil {
+		return
+	}
+	close(config.crlManager.stopCh)
+	<-config.crlManager.stoppedCh
+}
+
+func (m *crlManager) run() {
+	defer close(m.stoppedCh)
+
+	// Jitter the first tick so a fleet of smokescreen instances restarted
+	// together doesn't hammer CRL endpoints in lockstep.
+	jitter := time.Duration(rand.Int63n(int64(m.config.CrlRefreshInterval)))
+	m.refreshTicker = time.NewTicker(m.config.CrlRefreshInterval)
+	defer m.refreshTicker.Stop()
+
+	timer := time.NewTimer(jitter)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-m.stopCh:
+			return
+		case <-timer.C:
+			m.refreshAll()
+		case <-m.refreshTicker.C:
+			m.refreshAll()
+		}
+	}
+}
+
+func (m *crlManager) refreshAll() {
+	m.mu.Lock()
+	issuers := make([]string, 0, len(m.urlsByIssuer))
+	for issuer := range m.urlsByIssuer {
+		issuers = append(issuers, issuer)
+	}
+	m.mu.Unlock()
+
+	for _, issuer := range issuers {
+		m.refreshIssuer(issuer)
+	}
+
+	m.checkStaleness()
+}
+
+func (m *crlManager) refreshIssuer(authorityKeyId string) {
+	config := m.config
+
+	m.mu.Lock()
+	urls := append([]string(nil), m.urlsByIssuer[authorityKeyId]...)
+	m.mu.Unlock()
+
+	if len(urls) == 0 {
+		return
+	}
+
+	caCert, ok := config.getClientCa(authorityKeyId)
+	if !ok {
+		config.Log.Printf("warn: no CA loaded for Authority ID '%s', skipping CRL refresh", hex.EncodeToString([]byte(authorityKeyId)))
+		return
+	}
+
+	var lastErr error
+	for _, url := range urls {
+		certList, err := fetchCrl(url)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if err := caCert.CheckCRLSignature(certList); err != nil {
+			lastErr = fmt.Errorf("CRL from '%s' failed signature check: %w", url, err)
+			continue
+		}
+
+		config.crlMu.Lock()
+		config.CrlByAuthorityKeyId[authorityKeyId] = certList
+		delete(config.hardExpiredAuthorityKeyIds, authorityKeyId)
+		config.crlMu.Unlock()
+
+		m.mu.Lock()
+		m.fetchedAt[authorityKeyId] = time.Now()
+		m.mu.Unlock()
+
+		config.emitCrlGauge("smokescreen.crl.refresh_success", authorityKeyId, 1)
+		config.emitCrlStaleness(authorityKeyId, certList.TBSCertList.NextUpdate)
+		return
+	}
+
+	// Every Distribution Point failed: keep serving the previously-trusted
+	// CRL rather than evicting it.
+	config.Log.Printf("warn: failed to refresh CRL for Authority ID '%s': %v", hex.EncodeToString([]byte(authorityKeyId)), lastErr)
+	config.emitCrlGauge("smokescreen.crl.refresh_success", authorityKeyId, 0)
+}
+
+func (m *crlManager) checkStaleness() {
+	config := m.config
+
+	config.crlMu.Lock()
+	defer config.crlMu.Unlock()
+
+	if config.hardExpiredAuthorityKeyIds == nil {
+		config.hardExpiredAuthorityKeyIds = make(map[string]bool)
+	}
+
+	for authorityKeyId, certList := range config.CrlByAuthorityKeyId {
+		nextUpdate := certList.TBSCertList.NextUpdate
+		staleness := time.Since(nextUpdate)
+		config.emitCrlStaleness(authorityKeyId, nextUpdate)
+
+		if staleness > config.CrlHardExpiry {
+			config.Log.Printf("warn: CRL for Authority ID '%s' is stale by %s, past hard expiry of %s: treating CA as untrusted",
+				hex.EncodeToString([]byte(authorityKeyId)), staleness, config.CrlHardExpiry)
+			config.hardExpiredAuthorityKeyIds[authorityKeyId] = true
+		}
+	}
+}
+
+// isHardExpired reports whether the CA identified by authorityKeyId has
+// passed CrlHardExpiry and should no longer be trusted to authenticate
+// client certificates, regardless of whether its root is still present in
+// TlsConfig.ClientCAs.
+func (config *Config) isHardExpired(authorityKeyId string) bool {
+	config.crlMu.RLock()
+	defer config.crlMu.RUnlock()
+	return config.hardExpiredAuthorityKeyIds[authorityKeyId]
+}
+
+// checkCrlRevocation reports whether leaf, issued by issuer, is not revoked
+// according to the CRL cached for issuer's Authority Key Identifier. If no
+// CRL is loaded for that issuer it returns true: there is nothing to check
+// against, matching SetupCrls' existing warn-only behavior for CAs missing a
+// CRL.
+func (config *Config) checkCrlRevocation(leaf, issuer *x509.Certificate) (bool, error) {
+	authorityKeyId := string(issuer.SubjectKeyId)
+
+	if config.isHardExpired(authorityKeyId) {
+		return false, fmt.Errorf("CRL for Authority ID '%s' is past hard expiry, issuing CA is no longer trusted", hex.EncodeToString(issuer.SubjectKeyId))
+	}
+
+	config.crlMu.RLock()
+	certList, ok := config.CrlByAuthorityKeyId[authorityKeyId]
+	config.crlMu.RUnlock()
+	if !ok {
+		return true, nil
+	}
+
+	for _, revoked := range certList.TBSCertList.RevokedCertificates {
+		if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func fetchCrl(url string) (*pkix.CertificateList, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching CRL from '%s'", resp.StatusCode, url)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCrlBytes(body)
+}
+
+func (config *Config) emitCrlGauge(name, authorityKeyId string, value float64) {
+	if config.StatsdClient == nil {
+		return
+	}
+	tags := []string{"authority_key_id:" + hex.EncodeToString([]byte(authorityKeyId))}
+	config.StatsdClient.Gauge(name, value, tags, 1)
+}
+
+func (config *Config) emitCrlStaleness(authorityKeyId string, nextUpdate time.Time) {
+	if config.StatsdClient == nil {
+		return
+	}
+	tags := []string{"authority_key_id:" + hex.EncodeToString([]byte(authorityKeyId))}
+	config.StatsdClient.Gauge("smokescreen.crl.staleness_seconds", time.Since(nextUpdate).Seconds(), tags, 1)
+}
+
+// emitCrlCounter increments smokescreen.crl.<result>, mirroring
+// emitOcspCounter's smokescreen.ocsp.<result> but kept as a distinct metric
+// so a CRL-driven rejection in verifyPeerCertificateRevocation can be told
+// apart from an OCSP-driven one.
+func (config *Config) emitCrlCounter(result string) {
+	if config.StatsdClient == nil {
+		return
+	}
+	config.StatsdClient.Incr(fmt.Sprintf("smokescreen.crl.%s", result), nil, 1)
+}
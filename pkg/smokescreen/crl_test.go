@@ -0,0 +1,55 @@
+package smokescreen
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestCrlAuthorityKeyId(t *testing.T) {
+	wantId := []byte{0xDE, 0xAD, 0xBE, 0xEF}
+	encoded, err := asn1.Marshal(authKeyId{Id: wantId})
+	if err != nil {
+		t.Fatalf("failed to encode test AuthorityKeyId: %v", err)
+	}
+
+	certList := &pkix.CertificateList{
+		TBSCertList: pkix.TBSCertificateList{
+			Extensions: []pkix.Extension{
+				{Id: asn1.ObjectIdentifier{2, 5, 29, 35}, Value: encoded},
+			},
+		},
+	}
+
+	got := crlAuthorityKeyId(certList)
+	if got != string(wantId) {
+		t.Errorf("crlAuthorityKeyId() = %x, want %x", got, wantId)
+	}
+}
+
+func TestCrlAuthorityKeyIdMissing(t *testing.T) {
+	certList := &pkix.CertificateList{
+		TBSCertList: pkix.TBSCertificateList{
+			Extensions: []pkix.Extension{
+				{Id: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: []byte("irrelevant")},
+			},
+		},
+	}
+
+	if got := crlAuthorityKeyId(certList); got != "" {
+		t.Errorf("crlAuthorityKeyId() = %q, want empty string", got)
+	}
+}
+
+func TestAppendUnique(t *testing.T) {
+	urls := appendUnique(nil, "http://example.com/crl")
+	urls = appendUnique(urls, "http://example.com/crl")
+	urls = appendUnique(urls, "http://example.com/other")
+
+	if len(urls) != 2 {
+		t.Fatalf("appendUnique() = %v, want 2 unique entries", urls)
+	}
+	if urls[0] != "http://example.com/crl" || urls[1] != "http://example.com/other" {
+		t.Errorf("appendUnique() = %v, unexpected contents", urls)
+	}
+}
@@ -0,0 +1,344 @@
+package smokescreen
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// RevocationMode controls how (and whether) client certificate revocation is
+// checked during the mTLS handshake.
+type RevocationMode int
+
+const (
+	// RevocationOff performs no revocation checking beyond chain
+	// verification.
+	RevocationOff RevocationMode = iota
+	// RevocationCRL checks presented client certificates against
+	// Config.CrlByAuthorityKeyId only.
+	RevocationCRL
+	// RevocationOCSP checks presented client certificates against their
+	// issuer's OCSP responder only.
+	RevocationOCSP
+	// RevocationBoth checks both CRLs and OCSP; a cert revoked by either is
+	// rejected.
+	RevocationBoth
+)
+
+// ocspCacheEntry holds a cached OCSP response for a single certificate.
+type ocspCacheEntry struct {
+	response   *ocsp.Response
+	thisUpdate time.Time
+	nextUpdate time.Time
+}
+
+type ocspCache struct {
+	mu      sync.RWMutex
+	entries map[string]*ocspCacheEntry
+}
+
+func newOcspCache() *ocspCache {
+	return &ocspCache{entries: make(map[string]*ocspCacheEntry)}
+}
+
+func ocspCacheKey(issuerKeyId []byte, serial string) string {
+	return hex.EncodeToString(issuerKeyId) + ":" + serial
+}
+
+func (c *ocspCache) get(key string) (*ocspCacheEntry, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+func (c *ocspCache) set(key string, entry *ocspCacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = entry
+}
+
+// SetupOcsp enables OCSP-based client certificate revocation checking. mode
+// determines whether OCSP runs instead of, or alongside, CRL checking.
+// responderOverrides lets an operator pin an OCSP responder URL per issuer
+// (keyed by hex-encoded Authority Key Identifier) when a cert's OCSPServer
+// field is missing or untrusted. softFail, when true, treats OCSP lookup
+// failures (network errors, malformed responses) as "good" rather than
+// rejecting the connection.
+func (config *Config) SetupOcsp(mode RevocationMode, responderOverrides map[string]string, softFail bool) error {
+	config.RevocationMode = mode
+	config.OcspResponderOverrides = responderOverrides
+	config.OcspSoftFail = softFail
+	config.ocspCache = newOcspCache()
+
+	cfg := config.getTlsConfig()
+	if cfg == nil {
+		return fmt.Errorf("SetupOcsp must be called after SetupTls")
+	}
+
+	if mode != RevocationOff {
+		newCfg := cfg.Clone()
+		newCfg.VerifyPeerCertificate = config.verifyPeerCertificateRevocation
+		config.setTlsConfig(newCfg)
+		config.wireGetConfigForClient()
+	}
+
+	return nil
+}
+
+// verifyPeerCertificateRevocation is installed as
+// tls.Config.VerifyPeerCertificate and checks the leaf client certificate of
+// every verified chain (after chain verification has already succeeded)
+// against its issuer, using whichever revocation sources
+// config.RevocationMode selects. Intermediate certificates in the chain are
+// not checked. For RevocationBoth, a certificate revoked by either CRL or
+// OCSP is rejected.
+func (config *Config) verifyPeerCertificateRevocation(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		if len(chain) < 2 {
+			continue
+		}
+		leaf, issuer := chain[0], chain[1]
+
+		if config.RevocationMode == RevocationCRL || config.RevocationMode == RevocationBoth {
+			good, err := config.checkCrlRevocation(leaf, issuer)
+			if err != nil {
+				return err
+			}
+			if !good {
+				config.emitCrlCounter("revoked")
+				return fmt.Errorf("client certificate with serial '%s' is revoked", leaf.SerialNumber)
+			}
+		}
+
+		if config.RevocationMode == RevocationOCSP || config.RevocationMode == RevocationBoth {
+			good, err := config.checkOcsp(leaf, issuer)
+			if err != nil {
+				if config.OcspSoftFail {
+					config.Log.Printf("warn: OCSP check failed for serial '%s', soft-failing open: %v", leaf.SerialNumber, err)
+					config.emitOcspCounter("error")
+					continue
+				}
+				config.emitOcspCounter("error")
+				return fmt.Errorf("OCSP check failed for serial '%s': %w", leaf.SerialNumber, err)
+			}
+
+			if !good {
+				config.emitOcspCounter("revoked")
+				return fmt.Errorf("client certificate with serial '%s' is revoked", leaf.SerialNumber)
+			}
+		}
+	}
+	return nil
+}
+
+// checkOcsp returns true if leaf, issued by issuer, is not revoked according
+// to OCSP. Results are cached in-memory by serial + issuer key ID, honoring
+// the response's ThisUpdate/NextUpdate window.
+func (config *Config) checkOcsp(leaf, issuer *x509.Certificate) (bool, error) {
+	key := ocspCacheKey(issuer.SubjectKeyId, leaf.SerialNumber.String())
+
+	if entry, ok := config.ocspCache.get(key); ok && time.Now().Before(entry.nextUpdate) {
+		return entry.response.Status == ocsp.Good, nil
+	}
+
+	responderURL := leaf.OCSPServer
+	var url string
+	if len(responderURL) > 0 {
+		url = responderURL[0]
+	}
+	if override, ok := config.OcspResponderOverrides[hex.EncodeToString(issuer.SubjectKeyId)]; ok {
+		url = override
+	}
+	if url == "" {
+		config.emitOcspCounter("unknown")
+		return false, fmt.Errorf("no OCSP responder URL for serial '%s'", leaf.SerialNumber)
+	}
+
+	response, err := fetchOcspResponse(url, leaf, issuer)
+	if err != nil {
+		return false, err
+	}
+
+	config.ocspCache.set(key, &ocspCacheEntry{
+		response:   response,
+		thisUpdate: response.ThisUpdate,
+		nextUpdate: response.NextUpdate,
+	})
+
+	switch response.Status {
+	case ocsp.Good:
+		config.emitOcspCounter("good")
+		return true, nil
+	case ocsp.Revoked:
+		return false, nil
+	default:
+		config.emitOcspCounter("unknown")
+		return false, fmt.Errorf("OCSP responder returned unknown status for serial '%s'", leaf.SerialNumber)
+	}
+}
+
+func fetchOcspResponse(responderURL string, leaf, issuer *x509.Certificate) (*ocsp.Response, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, responderURL, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ocsp.ParseResponseForCert(body, leaf, issuer)
+}
+
+func (config *Config) emitOcspCounter(result string) {
+	if config.StatsdClient == nil {
+		return
+	}
+	config.StatsdClient.Incr(fmt.Sprintf("smokescreen.ocsp.%s", result), nil, 1)
+}
+
+// StartOcspStapling pre-fetches an OCSP response for
+// TlsConfig.Certificates[0] and keeps it refreshed, setting
+// Certificate.OCSPStaple so the server can staple it during the TLS
+// handshake. issuer is the signer of the server leaf certificate.
+func (config *Config) StartOcspStapling(issuer *x509.Certificate, refreshInterval time.Duration) error {
+	if len(config.getTlsConfig().Certificates) == 0 {
+		return fmt.Errorf("StartOcspStapling requires at least one certificate in TlsConfig.Certificates")
+	}
+
+	config.ocspStapleMu.Lock()
+	if config.ocspStapleStopCh != nil {
+		config.ocspStapleMu.Unlock()
+		return fmt.Errorf("OCSP stapling is already running; call StopOcspStapling first")
+	}
+	stopCh := make(chan struct{})
+	stoppedCh := make(chan struct{})
+	config.ocspStapleStopCh = stopCh
+	config.ocspStapleStoppedCh = stoppedCh
+	config.ocspStapleMu.Unlock()
+
+	if err := config.refreshOcspStaple(issuer); err != nil {
+		config.ocspStapleMu.Lock()
+		if config.ocspStapleStopCh == stopCh {
+			config.ocspStapleStopCh = nil
+			config.ocspStapleStoppedCh = nil
+		}
+		config.ocspStapleMu.Unlock()
+		close(stoppedCh)
+		return err
+	}
+
+	go func() {
+		defer close(stoppedCh)
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if err := config.refreshOcspStaple(issuer); err != nil {
+					config.Log.Printf("warn: failed to refresh OCSP staple: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+// StopOcspStapling signals the OCSP stapling refresh goroutine started by
+// StartOcspStapling to exit and waits for it to finish. It is a no-op if
+// stapling was never started.
+func (config *Config) StopOcspStapling() {
+	config.ocspStapleMu.Lock()
+	stopCh := config.ocspStapleStopCh
+	stoppedCh := config.ocspStapleStoppedCh
+	config.ocspStapleStopCh = nil
+	config.ocspStapleStoppedCh = nil
+	config.ocspStapleMu.Unlock()
+
+	if stopCh == nil {
+		return
+	}
+	close(stopCh)
+	<-stoppedCh
+}
+
+// refreshOcspStaple fetches a fresh OCSP staple for the server's leaf
+// certificate and swaps in a cloned *tls.Config carrying it, rather than
+// mutating config.TlsConfig.Certificates[0] in place, since that slice is
+// read by concurrent handshakes and could be swapped out from under us by a
+// concurrent Reload.
+func (config *Config) refreshOcspStaple(issuer *x509.Certificate) error {
+	cfg := config.getTlsConfig()
+	leafCert := cfg.Certificates[0]
+	leaf, err := x509.ParseCertificate(leafCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	var url string
+	if len(leaf.OCSPServer) > 0 {
+		url = leaf.OCSPServer[0]
+	}
+	if url == "" {
+		return fmt.Errorf("server certificate has no OCSPServer URL to staple from")
+	}
+
+	response, err := fetchOcspResponseRaw(url, leaf, issuer)
+	if err != nil {
+		return err
+	}
+
+	leafCert.OCSPStaple = response
+
+	newCfg := cfg.Clone()
+	newCfg.Certificates = append([]tls.Certificate{leafCert}, cfg.Certificates[1:]...)
+	config.setTlsConfig(newCfg)
+	config.wireGetConfigForClient()
+	return nil
+}
+
+func fetchOcspResponseRaw(responderURL string, leaf, issuer *x509.Certificate) ([]byte, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, responderURL, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,39 @@
+package smokescreen
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestOcspCacheKey(t *testing.T) {
+	got := ocspCacheKey([]byte{0xDE, 0xAD, 0xBE, 0xEF}, "12345")
+	want := "deadbeef:12345"
+	if got != want {
+		t.Errorf("ocspCacheKey() = %q, want %q", got, want)
+	}
+}
+
+func TestCheckOcspCacheHit(t *testing.T) {
+	config := &Config{ocspCache: newOcspCache()}
+
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(42)}
+	issuer := &x509.Certificate{SubjectKeyId: []byte{0x01, 0x02}}
+
+	key := ocspCacheKey(issuer.SubjectKeyId, leaf.SerialNumber.String())
+	config.ocspCache.set(key, &ocspCacheEntry{
+		response:   &ocsp.Response{Status: ocsp.Good},
+		nextUpdate: time.Now().Add(time.Hour),
+	})
+
+	good, err := config.checkOcsp(leaf, issuer)
+	if err != nil {
+		t.Fatalf("checkOcsp() returned error on cache hit: %v", err)
+	}
+	if !good {
+		t.Errorf("checkOcsp() = false, want true for a cached ocsp.Good entry")
+	}
+}
@@ -0,0 +1,271 @@
+package smokescreen
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadableConfig tracks the file paths that were used to build the
+// current Config, so Reload can re-read them from scratch without the
+// caller having to remember what it passed to Setup*.
+type reloadableConfig struct {
+	mu sync.RWMutex
+
+	certKeyPairs  [][2]string
+	clientCAFiles []string
+	p12File       string
+	p12Password   string
+	crlFiles      []string
+	aclFile       string
+
+	aclSubscribers []func(EgressAcl)
+}
+
+// SubscribeAclReload registers fn to be called with the new EgressAcl
+// whenever Reload swaps one in, so callers that cache the policy (rather
+// than reading config.EgressAcl directly on every request) don't serve a
+// stale one after a reload.
+func (config *Config) SubscribeAclReload(fn func(EgressAcl)) {
+	config.ensureReloadable()
+	config.reloadable.mu.Lock()
+	config.reloadable.aclSubscribers = append(config.reloadable.aclSubscribers, fn)
+	config.reloadable.mu.Unlock()
+}
+
+func (config *Config) ensureReloadable() {
+	if config.reloadable == nil {
+		config.reloadable = &reloadableConfig{}
+	}
+}
+
+// setTlsConfig swaps in a newly-built *tls.Config. All Setup* functions
+// must go through this (rather than assigning config.TlsConfig directly) so
+// that concurrent readers - a Reload in flight, an in-progress handshake via
+// GetConfigForClient - never observe a torn write.
+func (config *Config) setTlsConfig(cfg *tls.Config) {
+	config.tlsMu.Lock()
+	defer config.tlsMu.Unlock()
+	config.TlsConfig = cfg
+}
+
+// getTlsConfig returns the current *tls.Config under the same lock used by
+// setTlsConfig.
+func (config *Config) getTlsConfig() *tls.Config {
+	config.tlsMu.RLock()
+	defer config.tlsMu.RUnlock()
+	return config.TlsConfig
+}
+
+// wireGetConfigForClient installs a GetConfigForClient callback on the
+// current TlsConfig that always returns the live config. A tls.Listener
+// captures the *tls.Config pointer it was constructed with once, so without
+// this every Setup* call - not just the ones triggered by Reload - must set
+// it, or a server that hasn't reloaded yet never picks up a later swap.
+func (config *Config) wireGetConfigForClient() {
+	config.tlsMu.Lock()
+	defer config.tlsMu.Unlock()
+	if config.TlsConfig == nil {
+		return
+	}
+	config.TlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return config.getTlsConfig(), nil
+	}
+}
+
+// Reload re-reads the server cert/key pair(s), client CA files, CRL files,
+// and ACL YAML that were last used to configure this Config, in that order,
+// and swaps each one in under its own lock as soon as it has been read. A
+// step that fails leaves its previous, already-live configuration in place,
+// and the steps after it are not run; steps that completed earlier in the
+// same call keep their new material, so a reload is not all-or-nothing
+// across components. Failures are reported via StatsdClient and config.Log
+// and returned to the caller rather than to in-flight connections.
+func (config *Config) Reload() error {
+	config.ensureReloadable()
+	config.reloadable.mu.RLock()
+	certKeyPairs := append([][2]string(nil), config.reloadable.certKeyPairs...)
+	clientCAFiles := append([]string(nil), config.reloadable.clientCAFiles...)
+	p12File := config.reloadable.p12File
+	p12Password := config.reloadable.p12Password
+	crlFiles := append([]string(nil), config.reloadable.crlFiles...)
+	aclFile := config.reloadable.aclFile
+	config.reloadable.mu.RUnlock()
+
+	if err := config.reloadTls(certKeyPairs, clientCAFiles, p12File, p12Password); err != nil {
+		config.reportReloadFailure("tls", err)
+		return err
+	}
+
+	// reloadTls builds a brand-new *tls.Config with no VerifyPeerCertificate,
+	// so if client cert revocation checking was enabled, re-wire it onto the
+	// new config the same way SetupOcsp originally did - otherwise a reload
+	// silently disables CRL/OCSP enforcement for every connection after it.
+	if config.RevocationMode != RevocationOff {
+		if err := config.SetupOcsp(config.RevocationMode, config.OcspResponderOverrides, config.OcspSoftFail); err != nil {
+			config.reportReloadFailure("revocation", err)
+			return err
+		}
+	}
+
+	if len(crlFiles) != 0 {
+		if err := config.SetupCrls(crlFiles); err != nil {
+			config.reportReloadFailure("crl", err)
+			return err
+		}
+	}
+
+	if aclFile != "" {
+		previousAcl := config.EgressAcl
+		if err := config.SetupEgressAcl(aclFile); err != nil {
+			config.EgressAcl = previousAcl
+			config.reportReloadFailure("acl", err)
+			return err
+		}
+		config.notifyAclSubscribers(config.EgressAcl)
+	}
+
+	config.Log.Print("info: configuration reloaded successfully")
+	if config.StatsdClient != nil {
+		config.StatsdClient.Incr("smokescreen.reload.success", nil, 1)
+	}
+
+	return nil
+}
+
+// reloadTls re-runs whichever Setup* built the current TLS material. None
+// of SetupTls/SetupTlsMulti/SetupTlsFromPKCS12 assign config.TlsConfig until
+// every file has been read and parsed successfully, so on error the
+// previous, already-live *tls.Config is simply left untouched - there is
+// nothing to restore here.
+func (config *Config) reloadTls(certKeyPairs [][2]string, clientCAFiles []string, p12File, p12Password string) error {
+	if p12File != "" {
+		return config.SetupTlsFromPKCS12(p12File, p12Password, clientCAFiles)
+	}
+
+	if len(certKeyPairs) == 0 {
+		return nil
+	}
+
+	if len(certKeyPairs) == 1 {
+		return config.SetupTls(certKeyPairs[0][0], certKeyPairs[0][1], clientCAFiles)
+	}
+	return config.SetupTlsMulti(certKeyPairs, clientCAFiles)
+}
+
+func (config *Config) notifyAclSubscribers(acl EgressAcl) {
+	config.reloadable.mu.RLock()
+	subscribers := append([]func(EgressAcl){}, config.reloadable.aclSubscribers...)
+	config.reloadable.mu.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(acl)
+	}
+}
+
+func (config *Config) reportReloadFailure(component string, err error) {
+	config.Log.Printf("error: config reload failed while reloading %s, keeping previous configuration: %v", component, err)
+	if config.StatsdClient != nil {
+		config.StatsdClient.Incr("smokescreen.reload.failure", []string{"component:" + component}, 1)
+	}
+}
+
+// WatchFiles watches the tracked server cert/key, client CA, CRL, and ACL
+// file paths for changes using fsnotify, calling Reload whenever one
+// changes. It also installs a SIGHUP handler as a fallback for filesystems
+// (e.g. some network mounts, or a bind-mount swap) where fsnotify events
+// aren't delivered. It blocks until ctx is canceled.
+func (config *Config) WatchFiles(ctx context.Context) error {
+	config.ensureReloadable()
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range config.watchedDirs() {
+		if err := watcher.Add(dir); err != nil {
+			config.Log.Printf("warn: could not watch '%s' for config reload: %v", dir, err)
+		}
+	}
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-sighup:
+			config.Log.Print("info: received SIGHUP, reloading configuration")
+			if err := config.Reload(); err != nil {
+				config.Log.Printf("error: reload triggered by SIGHUP failed: %v", err)
+			}
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			config.Log.Printf("info: detected change to '%s', reloading configuration", event.Name)
+			if err := config.Reload(); err != nil {
+				config.Log.Printf("error: reload triggered by file change failed: %v", err)
+			}
+		case watchErr, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			config.Log.Printf("warn: fsnotify watcher error: %v", watchErr)
+		}
+	}
+}
+
+func (config *Config) watchedDirs() []string {
+	config.reloadable.mu.RLock()
+	defer config.reloadable.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	var dirs []string
+	add := func(path string) {
+		if path == "" {
+			return
+		}
+		dir := dirOf(path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, pair := range config.reloadable.certKeyPairs {
+		add(pair[0])
+		add(pair[1])
+	}
+	for _, f := range config.reloadable.clientCAFiles {
+		add(f)
+	}
+	add(config.reloadable.p12File)
+	for _, f := range config.reloadable.crlFiles {
+		add(f)
+	}
+	add(config.reloadable.aclFile)
+
+	return dirs
+}
+
+func dirOf(path string) string {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == '/' {
+			return path[:i]
+		}
+	}
+	return "."
+}
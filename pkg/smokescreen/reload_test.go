@@ -0,0 +1,111 @@
+package smokescreen
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirOf(t *testing.T) {
+	cases := map[string]string{
+		"/etc/smokescreen/server.crt": "/etc/smokescreen",
+		"server.crt":                  ".",
+		"/server.crt":                 "",
+		"a/b/c":                       "a/b",
+	}
+
+	for path, want := range cases {
+		if got := dirOf(path); got != want {
+			t.Errorf("dirOf(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+// writeSelfSignedCert generates a throwaway self-signed cert/key pair under
+// dir and returns their paths, for tests that need a real *tls.Config rather
+// than a hand-built one.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smokescreen-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:         true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create test certificate: %v", err)
+	}
+
+	certFile = filepath.Join(dir, "server.crt")
+	keyFile = filepath.Join(dir, "server.key")
+
+	certOut, err := os.Create(certFile)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", certFile, err)
+	}
+	defer certOut.Close()
+	if err := pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		t.Fatalf("failed to write %s: %v", certFile, err)
+	}
+
+	keyOut, err := os.Create(keyFile)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", keyFile, err)
+	}
+	defer keyOut.Close()
+	if err := pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}); err != nil {
+		t.Fatalf("failed to write %s: %v", keyFile, err)
+	}
+
+	return certFile, keyFile
+}
+
+// TestReloadPreservesRevocationHook guards against a regression where Reload
+// rebuilds TlsConfig from scratch via reloadTls, dropping the
+// VerifyPeerCertificate hook SetupOcsp had installed - silently disabling
+// CRL/OCSP enforcement on every connection handled after a reload.
+func TestReloadPreservesRevocationHook(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeSelfSignedCert(t, dir)
+
+	config := &Config{}
+	if err := config.Init(); err != nil {
+		t.Fatalf("Init() failed: %v", err)
+	}
+
+	if err := config.SetupTls(certFile, keyFile, nil); err != nil {
+		t.Fatalf("SetupTls() failed: %v", err)
+	}
+	if err := config.SetupOcsp(RevocationCRL, nil, false); err != nil {
+		t.Fatalf("SetupOcsp() failed: %v", err)
+	}
+
+	if config.getTlsConfig().VerifyPeerCertificate == nil {
+		t.Fatalf("VerifyPeerCertificate not wired after SetupOcsp")
+	}
+
+	if err := config.Reload(); err != nil {
+		t.Fatalf("Reload() failed: %v", err)
+	}
+
+	if config.getTlsConfig().VerifyPeerCertificate == nil {
+		t.Errorf("VerifyPeerCertificate was dropped by Reload(), revocation checking is silently disabled")
+	}
+}
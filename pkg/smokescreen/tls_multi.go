@@ -0,0 +1,61 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// SetupTlsMulti configures server TLS from several cert/key pairs, indexed
+// by SNI, so a single smokescreen instance can terminate several
+// client-facing hostnames while sharing one egress ACL, CRL set, and role
+// extraction. Each entry in certKeyPairs is a [certFile, keyFile] pair,
+// loaded the same way SetupTls loads its single pair.
+func (config *Config) SetupTlsMulti(certKeyPairs [][2]string, clientCAFiles []string) error {
+	if len(certKeyPairs) == 0 {
+		return errors.New("at least one certificate/key pair must be specified to set up TLS")
+	}
+
+	certificates := make([]tls.Certificate, 0, len(certKeyPairs))
+	for _, pair := range certKeyPairs {
+		certFile, keyFile := pair[0], pair[1]
+		if certFile == "" || keyFile == "" {
+			return errors.New("both certificate and key files must be specified to set up TLS")
+		}
+
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		certificates = append(certificates, cert)
+	}
+
+	clientAuth := tls.NoClientCert
+	clientCAs := x509.NewCertPool()
+
+	if len(clientCAFiles) != 0 {
+		clientAuth = tls.VerifyClientCertIfGiven
+		for _, caFile := range clientCAFiles {
+			if err := addCertsFromFile(config, clientCAs, caFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	newConfig := &tls.Config{
+		Certificates: certificates,
+		ClientAuth:   clientAuth,
+		ClientCAs:    clientCAs,
+	}
+	newConfig.BuildNameToCertificate()
+	config.setTlsConfig(newConfig)
+	config.wireGetConfigForClient()
+
+	config.ensureReloadable()
+	config.reloadable.mu.Lock()
+	config.reloadable.certKeyPairs = append([][2]string(nil), certKeyPairs...)
+	config.reloadable.clientCAFiles = clientCAFiles
+	config.reloadable.mu.Unlock()
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package smokescreen
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// SetupTlsFromPKCS12 configures server TLS from a PKCS#12 (.p12/.pfx) bundle
+// instead of separate PEM cert/key files, mirroring the distribution format
+// many enterprises use to hand mTLS material to proxies. Any CA certificates
+// present in the bundle are assumed to complete the server's own chain (as
+// they normally do in such bundles) and are fed through populateClientCaMap
+// purely so CRL matching by Subject Key Identifier continues to work - they
+// are not added to the client-auth trust pool, since that would silently
+// enable mTLS trusting whatever CA happens to be bundled alongside the
+// server cert. Client CAs must still be supplied explicitly via
+// clientCAFiles.
+func (config *Config) SetupTlsFromPKCS12(p12File, password string, clientCAFiles []string) error {
+	if p12File == "" {
+		return errors.New("a PKCS#12 bundle file must be specified to set up TLS")
+	}
+
+	p12Data, err := ioutil.ReadFile(p12File)
+	if err != nil {
+		return err
+	}
+
+	privateKey, leaf, caCerts, err := pkcs12.DecodeChain(p12Data, password)
+	if err != nil {
+		return err
+	}
+
+	serverCert := tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  privateKey,
+		Leaf:        leaf,
+	}
+	for _, caCert := range caCerts {
+		serverCert.Certificate = append(serverCert.Certificate, caCert.Raw)
+		config.populateClientCaMap(certToPem(caCert))
+	}
+
+	clientAuth := tls.NoClientCert
+	clientCAs := x509.NewCertPool()
+
+	if len(clientCAFiles) != 0 {
+		clientAuth = tls.VerifyClientCertIfGiven
+		for _, caFile := range clientCAFiles {
+			if err := addCertsFromFile(config, clientCAs, caFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	config.setTlsConfig(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   clientAuth,
+		ClientCAs:    clientCAs,
+	})
+	config.wireGetConfigForClient()
+
+	config.ensureReloadable()
+	config.reloadable.mu.Lock()
+	config.reloadable.p12File = p12File
+	config.reloadable.p12Password = password
+	config.reloadable.clientCAFiles = clientCAFiles
+	config.reloadable.mu.Unlock()
+
+	return nil
+}
+
+// certToPem renders an already-parsed certificate back to PEM so it can be
+// run through populateClientCaMap, which only knows how to decode PEM.
+func certToPem(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}